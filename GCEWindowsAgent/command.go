@@ -0,0 +1,144 @@
+//  Copyright 2017 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const commandMetadataRefresh = "agent.metadata.refresh"
+
+// commandRequest is the JSON payload sent by sibling processes (workload
+// cert refreshers, operator scripts) over the local command channel.
+type commandRequest struct {
+	Command string
+}
+
+// commandResponse is returned on the same connection after a command is
+// handled.
+type commandResponse struct {
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+// refreshMetadata is the handler registered for agent.metadata.refresh. It
+// fires metadataTrigger, which cuts short the etag hang in WatchMetadata;
+// the re-dispatch to the address, account and diagnostics managers is left
+// to the main loop. Tests replace the commandHandlers entry, not this
+// variable.
+var refreshMetadata = func(ctx context.Context) error {
+	metadataTrigger.trigger()
+	return nil
+}
+
+// metadataTrigger lets the command channel force watchMetadata's hang loop
+// to return immediately instead of waiting out metadataHang.
+var metadataTrigger = newRefreshTrigger()
+
+type refreshTrigger struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newRefreshTrigger() *refreshTrigger {
+	return &refreshTrigger{ch: make(chan struct{}, 1)}
+}
+
+// trigger requests an immediate re-fetch. It never blocks.
+func (r *refreshTrigger) trigger() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case r.ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait returns a channel that fires once per trigger call, including a
+// trigger still pending from before wait was called.
+func (r *refreshTrigger) wait() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ch
+}
+
+// commandHandlers maps the commands accepted on the local IPC channel to
+// their handlers. Handlers run with the listener's background context.
+// agent.metadata.refresh forces watchMetadata's hang loop to return
+// immediately; the main loop's normal dispatch to the address, account and
+// diagnostics managers then runs against the freshly fetched metadata.
+//
+// There is deliberately no agent.accounts.reset command yet: it would need
+// real account-reset semantics in the account manager, not just another
+// alias for a metadata refresh.
+var commandHandlers = map[string]func(context.Context) error{
+	commandMetadataRefresh: refreshMetadata,
+}
+
+// serveCommand runs for the lifetime of the listener, handling each accepted
+// connection in its own goroutine: it decodes a single commandRequest,
+// dispatches it to commandHandlers and writes back a commandResponse.
+func serveCommand(ctx context.Context, l net.Listener) {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Errorf("command channel accept error: %v", err)
+			continue
+		}
+		go handleCommandConn(ctx, conn)
+	}
+}
+
+func handleCommandConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	var req commandRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		writeCommandResponse(conn, commandResponse{Status: "error", Error: err.Error()})
+		return
+	}
+
+	handler, ok := commandHandlers[req.Command]
+	if !ok {
+		writeCommandResponse(conn, commandResponse{Status: "error", Error: "unknown command: " + req.Command})
+		return
+	}
+
+	if err := handler(ctx); err != nil {
+		writeCommandResponse(conn, commandResponse{Status: "error", Error: err.Error()})
+		return
+	}
+	writeCommandResponse(conn, commandResponse{Status: "ok"})
+}
+
+func writeCommandResponse(conn net.Conn, resp commandResponse) {
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		logger.Errorf("failed to write command response: %v", err)
+	}
+}
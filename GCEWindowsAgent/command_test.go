@@ -0,0 +1,181 @@
+//  Copyright 2017 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestHandleCommandConnDispatchesKnownCommand(t *testing.T) {
+	orig := commandHandlers[commandMetadataRefresh]
+	defer func() { commandHandlers[commandMetadataRefresh] = orig }()
+
+	called := false
+	commandHandlers[commandMetadataRefresh] = func(ctx context.Context) error {
+		called = true
+		return nil
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		handleCommandConn(context.Background(), server)
+		close(done)
+	}()
+
+	if err := json.NewEncoder(client).Encode(commandRequest{Command: commandMetadataRefresh}); err != nil {
+		t.Fatalf("encode request: %v", err)
+	}
+	var resp commandResponse
+	if err := json.NewDecoder(client).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	<-done
+
+	if !called {
+		t.Error("expected the registered handler to be invoked")
+	}
+	if resp.Status != "ok" {
+		t.Errorf("Status = %q, want ok", resp.Status)
+	}
+	if resp.Error != "" {
+		t.Errorf("Error = %q, want empty", resp.Error)
+	}
+}
+
+func TestHandleCommandConnUnknownCommand(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		handleCommandConn(context.Background(), server)
+		close(done)
+	}()
+
+	if err := json.NewEncoder(client).Encode(commandRequest{Command: "not.a.real.command"}); err != nil {
+		t.Fatalf("encode request: %v", err)
+	}
+	var resp commandResponse
+	if err := json.NewDecoder(client).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	<-done
+
+	if resp.Status != "error" {
+		t.Errorf("Status = %q, want error", resp.Status)
+	}
+	if resp.Error == "" {
+		t.Error("expected a non-empty Error for an unknown command")
+	}
+}
+
+func TestHandleCommandConnMalformedJSON(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		handleCommandConn(context.Background(), server)
+		close(done)
+	}()
+
+	if _, err := client.Write([]byte("{not json")); err != nil {
+		t.Fatalf("write malformed request: %v", err)
+	}
+	var resp commandResponse
+	if err := json.NewDecoder(client).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	<-done
+
+	if resp.Status != "error" {
+		t.Errorf("Status = %q, want error", resp.Status)
+	}
+	if resp.Error == "" {
+		t.Error("expected a non-empty Error for malformed JSON")
+	}
+}
+
+func TestHandleCommandConnHandlerError(t *testing.T) {
+	orig := commandHandlers[commandMetadataRefresh]
+	defer func() { commandHandlers[commandMetadataRefresh] = orig }()
+	commandHandlers[commandMetadataRefresh] = func(ctx context.Context) error {
+		return errors.New("handler exploded")
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		handleCommandConn(context.Background(), server)
+		close(done)
+	}()
+
+	if err := json.NewEncoder(client).Encode(commandRequest{Command: commandMetadataRefresh}); err != nil {
+		t.Fatalf("encode request: %v", err)
+	}
+	var resp commandResponse
+	if err := json.NewDecoder(client).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	<-done
+
+	if resp.Status != "error" {
+		t.Errorf("Status = %q, want error", resp.Status)
+	}
+	if resp.Error != "handler exploded" {
+		t.Errorf("Error = %q, want %q", resp.Error, "handler exploded")
+	}
+}
+
+func TestServeCommandDispatchesOverRealListener(t *testing.T) {
+	// Stub the handler rather than letting the real refreshMetadata fire:
+	// it trips the package-level metadataTrigger, which would otherwise
+	// leak a pending trigger into whichever WatchMetadata test runs next.
+	orig := commandHandlers[commandMetadataRefresh]
+	defer func() { commandHandlers[commandMetadataRefresh] = orig }()
+	commandHandlers[commandMetadataRefresh] = func(ctx context.Context) error { return nil }
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveCommand(ctx, ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(commandRequest{Command: commandMetadataRefresh}); err != nil {
+		t.Fatalf("encode request: %v", err)
+	}
+	var resp commandResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Status != "ok" {
+		t.Errorf("Status = %q, want ok", resp.Status)
+	}
+}
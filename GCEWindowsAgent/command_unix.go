@@ -0,0 +1,44 @@
+//  Copyright 2017 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+)
+
+// commandSocket is the Unix domain socket the agent listens on for local
+// commands, kept consistent with the Windows named pipe counterpart for
+// tooling that runs on both.
+const commandSocket = "/var/run/google-guest-agent/command.sock"
+
+// startCommandListener opens the local command channel and serves requests
+// until ctx is canceled.
+func startCommandListener(ctx context.Context) error {
+	os.Remove(commandSocket)
+	l, err := net.Listen("unix", commandSocket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(commandSocket, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	serveCommand(ctx, l)
+	return nil
+}
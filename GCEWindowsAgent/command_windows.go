@@ -0,0 +1,42 @@
+//  Copyright 2017 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// commandPipe is the named pipe the agent listens on for local commands.
+// The security descriptor restricts connections to Administrators and
+// SYSTEM, matching the agent's own service account.
+const commandPipe = `\\.\pipe\GCEWindowsAgent\command`
+
+const commandPipeSDDL = "D:P(A;;GA;;;SY)(A;;GA;;;BA)"
+
+// startCommandListener opens the local command channel and serves requests
+// until ctx is canceled.
+func startCommandListener(ctx context.Context) error {
+	l, err := winio.ListenPipe(commandPipe, &winio.PipeConfig{
+		SecurityDescriptor: commandPipeSDDL,
+		MessageMode:        true,
+	})
+	if err != nil {
+		return err
+	}
+	serveCommand(ctx, l)
+	return nil
+}
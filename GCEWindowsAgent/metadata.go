@@ -16,11 +16,18 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
@@ -29,18 +36,221 @@ import (
 const defaultEtag = "NONE"
 
 var (
-	metadataURL       = "http://metadata.google.internal/computeMetadata/v1/"
 	metadataRecursive = "/?recursive=true&alt=json"
 	metadataHang      = "&wait_for_change=true&timeout_sec=60"
 	defaultTimeout    = 70 * time.Second
-	etag              = defaultEtag
+
+	// workloadCertPath and workloadKeyPath locate the mTLS credentials
+	// rotated on disk by the workload certificate refresher, matching the
+	// default GCE guest-agent layout.
+	workloadCertPath = `C:\ProgramData\Google\Compute Engine\mds-mtls-client.crt`
+	workloadKeyPath  = `C:\ProgramData\Google\Compute Engine\mds-mtls-client.key`
+	mdsRootCACert    = `C:\ProgramData\Google\Compute Engine\mds-mtls-root.crt`
 )
 
+// MetadataClient talks to the GCE metadata server: plain HTTP by default,
+// mTLS when a workload certificate is present on disk, over an injectable
+// http.RoundTripper so tests can substitute a Fake instead of the network.
+// Construct one with NewMetadataClient; the zero value is not usable.
+type MetadataClient struct {
+	baseURL     string
+	mtlsURL     string
+	timeout     time.Duration
+	transport   http.RoundTripper
+	now         func() time.Time
+	retryPolicy backoffPolicy
+
+	mu   sync.Mutex
+	etag string
+
+	mtlsMu          sync.Mutex
+	mtlsClient      *http.Client
+	mtlsRefreshedAt time.Time
+}
+
+// MetadataClientOption configures a MetadataClient built by
+// NewMetadataClient.
+type MetadataClientOption func(*MetadataClient)
+
+// WithBaseURL overrides the plain-HTTP metadata server base URL.
+func WithBaseURL(url string) MetadataClientOption {
+	return func(c *MetadataClient) { c.baseURL = url }
+}
+
+// WithTimeout overrides the per-request HTTP timeout.
+func WithTimeout(d time.Duration) MetadataClientOption {
+	return func(c *MetadataClient) { c.timeout = d }
+}
+
+// WithTransport overrides the http.RoundTripper used for plain-HTTP
+// requests, e.g. to inject a Fake in tests.
+func WithTransport(rt http.RoundTripper) MetadataClientOption {
+	return func(c *MetadataClient) { c.transport = rt }
+}
+
+// WithClock overrides the clock used to stamp MTLSRefreshedAt, so tests can
+// assert on it deterministically instead of depending on wall-clock time.
+func WithClock(now func() time.Time) MetadataClientOption {
+	return func(c *MetadataClient) { c.now = now }
+}
+
+// NewMetadataClient returns a MetadataClient pointed at the real GCE
+// metadata server by default. The mTLS refresher starts immediately and
+// runs for the life of the process: its existence can't depend on which
+// method happens to be called first, or on the lifetime of that caller's
+// ctx, since callers like GetMetadata expect mTLS to already be usable
+// (or known unusable) the moment the client is constructed.
+func NewMetadataClient(opts ...MetadataClientOption) *MetadataClient {
+	c := &MetadataClient{
+		baseURL:     "http://metadata.google.internal/computeMetadata/v1/",
+		mtlsURL:     "https://metadata.google.internal/computeMetadata/v1/",
+		timeout:     defaultTimeout,
+		transport:   http.DefaultTransport,
+		now:         time.Now,
+		retryPolicy: metadataRetryPolicy,
+		etag:        defaultEtag,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.startMTLSRefresher(context.Background(), 5*time.Minute)
+	return c
+}
+
+func (c *MetadataClient) httpClient() *http.Client {
+	return &http.Client{Timeout: c.timeout, Transport: c.transport}
+}
+
+func (c *MetadataClient) currentEtag() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.etag
+}
+
+func (c *MetadataClient) updateEtag(resp *http.Response) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	oldEtag := c.etag
+	c.etag = resp.Header.Get("etag")
+	if c.etag == "" {
+		c.etag = defaultEtag
+	}
+	return c.etag != oldEtag
+}
+
+// startMTLSRefresher performs an initial load and then periodically reloads
+// the workload certificate, rebuilding the mTLS-enabled http.Client used by
+// getMetadataMTLS. It runs for the lifetime of ctx and is a no-op (but
+// harmless) when the cert files never appear. Called once from
+// NewMetadataClient, not lazily from any particular caller.
+func (c *MetadataClient) startMTLSRefresher(ctx context.Context, interval time.Duration) {
+	c.refreshMTLSClient()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.refreshMTLSClient()
+			}
+		}
+	}()
+}
+
+// refreshMTLSClient reads the workload cert/key pair and MDS root CA from
+// disk and, if present, builds a new *http.Client pinned to them. Missing or
+// unreadable files clear the cached client so callers fall back to plain
+// HTTP.
+func (c *MetadataClient) refreshMTLSClient() {
+	cert, err := tls.LoadX509KeyPair(workloadCertPath, workloadKeyPath)
+	if err != nil {
+		c.setMTLSClient(nil)
+		return
+	}
+
+	rootPEM, err := ioutil.ReadFile(mdsRootCACert)
+	if err != nil {
+		c.setMTLSClient(nil)
+		return
+	}
+	rootPool := x509.NewCertPool()
+	if !rootPool.AppendCertsFromPEM(rootPEM) {
+		logger.Errorf("failed to parse MDS root CA from %s", mdsRootCACert)
+		c.setMTLSClient(nil)
+		return
+	}
+
+	c.setMTLSClient(&http.Client{
+		Timeout: c.timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				RootCAs:      rootPool,
+			},
+		},
+	})
+}
+
+func (c *MetadataClient) setMTLSClient(client *http.Client) {
+	c.mtlsMu.Lock()
+	c.mtlsClient = client
+	c.mtlsRefreshedAt = c.now()
+	c.mtlsMu.Unlock()
+}
+
+func (c *MetadataClient) currentMTLSClient() *http.Client {
+	c.mtlsMu.Lock()
+	defer c.mtlsMu.Unlock()
+	return c.mtlsClient
+}
+
+// MTLSRefreshedAt returns the time of the last mTLS credential reload
+// (successful or not; a nil client means the cert files were missing or
+// unreadable at that time), per the injected clock.
+func (c *MetadataClient) MTLSRefreshedAt() time.Time {
+	c.mtlsMu.Lock()
+	defer c.mtlsMu.Unlock()
+	return c.mtlsRefreshedAt
+}
+
 type metadataJSON struct {
 	Instance instanceJSON
 	Project  projectJSON
 }
 
+// UnmarshalJSON resolves Project.Attributes.SSHCAPublicKey before decoding
+// Instance, which may contain windows-ssh-ca-cert entries that need to
+// verify against it. The real recursive MDS response places "instance"
+// before "project" in the JSON text, so without this two-pass decode,
+// windows-ssh-ca-cert entries introduced in the same poll as a new
+// ssh-ca-public-key would validate against whatever key (if any) a
+// previous poll left behind instead of the one in this payload.
+func (m *metadataJSON) UnmarshalJSON(b []byte) error {
+	var probe struct {
+		Project struct {
+			Attributes struct {
+				SSHCAPublicKey string `json:"ssh-ca-public-key"`
+			}
+		}
+	}
+	if err := json.Unmarshal(b, &probe); err != nil {
+		return err
+	}
+	if probe.Project.Attributes.SSHCAPublicKey != "" {
+		sshCAPublicKey = probe.Project.Attributes.SSHCAPublicKey
+	}
+
+	type alias metadataJSON
+	var a alias
+	if err := json.Unmarshal(b, &a); err != nil {
+		return err
+	}
+	*m = metadataJSON(a)
+	return nil
+}
+
 type instanceJSON struct {
 	Attributes        attributesJSON
 	NetworkInterfaces []networkInterfacesJSON
@@ -59,6 +269,8 @@ type projectJSON struct {
 
 type attributesJSON struct {
 	WindowsKeys           windowsKeys
+	WindowsSSHCACert      windowsKeys
+	SSHCAPublicKey        string
 	Diagnostics           string
 	DisableAddressManager *bool
 	DisableAccountManager *bool
@@ -75,13 +287,81 @@ type windowsKey struct {
 	Modulus      string
 	UserName     string
 	HashFunction string
+
+	// Principals and Signature are set on entries parsed from the
+	// windows-ssh-ca-cert attribute instead of windows-keys: a short-lived
+	// credential signed by the CA key in the project's ssh-ca-public-key
+	// attribute, rather than a caller-supplied RSA modulus. ExpireOn doubles
+	// as the certificate's ValidBefore bound, so the existing expired()
+	// check governs deprovisioning for both key types; ValidAfter gates the
+	// start of the window via notYetValid(). Note that only this parsing
+	// and validation step lives here today - there is no account manager in
+	// this tree to actually provision/deprovision the account against
+	// ValidAfter/ExpireOn, so a validated entry only ever reaches *wks.
+	Principals []string
+	ValidAfter string
+	Signature  string
+}
+
+// caSigned reports whether wk was parsed from windows-ssh-ca-cert rather
+// than windows-keys.
+func (wk *windowsKey) caSigned() bool {
+	return wk.Signature != ""
+}
+
+// notYetValid reports whether wk's ValidAfter window hasn't started yet.
+// ValidAfter is parsed with the same format expired() expects for ExpireOn;
+// an unparseable ValidAfter is treated as not yet valid.
+func (wk *windowsKey) notYetValid() bool {
+	if wk.ValidAfter == "" {
+		return false
+	}
+	validAfter, err := time.Parse(time.RFC3339, wk.ValidAfter)
+	if err != nil {
+		logger.Errorf("failed to parse windows-ssh-ca-cert ValidAfter %q: %s", wk.ValidAfter, err)
+		return true
+	}
+	return time.Now().Before(validAfter)
+}
+
+// signedPayload is the canonical byte string the CA signs to authorize wk.
+func (wk *windowsKey) signedPayload() []byte {
+	return []byte(strings.Join([]string{wk.UserName, strings.Join(wk.Principals, ","), wk.ValidAfter, wk.ExpireOn}, "|"))
+}
+
+// verifyCASignature checks wk.Signature against the CA public key pulled
+// from the project's ssh-ca-public-key attribute.
+func (wk *windowsKey) verifyCASignature() error {
+	if sshCAPublicKey == "" {
+		return errors.New("no ssh-ca-public-key configured in project attributes")
+	}
+	pub, err := base64.StdEncoding.DecodeString(sshCAPublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("ssh-ca-public-key is not a valid base64 ed25519 public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(wk.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), wk.signedPayload(), sig) {
+		return errors.New("signature does not match configured CA public key")
+	}
+	return nil
 }
 
 type windowsKeys []windowsKey
 
+// sshCAPublicKey is the base64-encoded ed25519 CA public key used to
+// authorize windows-ssh-ca-cert entries. It is populated from the project's
+// ssh-ca-public-key attribute, which is expected to be present before any
+// instance windows-ssh-ca-cert entries are parsed.
+var sshCAPublicKey string
+
 func (a *attributesJSON) UnmarshalJSON(b []byte) error {
 	type inner struct {
 		WindowsKeys           windowsKeys `json:"windows-keys"`
+		WindowsSSHCACert      windowsKeys `json:"windows-ssh-ca-cert"`
+		SSHCAPublicKey        string      `json:"ssh-ca-public-key"`
 		Diagnostics           string      `json:"diagnostics"`
 		DisableAddressManager string      `json:"disable-address-manager"`
 		DisableAccountManager string      `json:"disable-account-manager"`
@@ -94,9 +374,14 @@ func (a *attributesJSON) UnmarshalJSON(b []byte) error {
 	if err := json.Unmarshal(b, &temp); err != nil {
 		return err
 	}
+	if temp.SSHCAPublicKey != "" {
+		sshCAPublicKey = temp.SSHCAPublicKey
+	}
 	a.Diagnostics = temp.Diagnostics
 	a.WSFCAddresses = temp.WSFCAddresses
 	a.WSFCAgentPort = temp.WSFCAgentPort
+	a.SSHCAPublicKey = temp.SSHCAPublicKey
+	a.WindowsSSHCACert = temp.WindowsSSHCACert
 	value, err := strconv.ParseBool(temp.DisableAddressManager)
 	if err == nil {
 		a.DisableAddressManager = &value
@@ -130,6 +415,18 @@ func (wks *windowsKeys) UnmarshalJSON(b []byte) error {
 			}
 			continue
 		}
+
+		if wk.caSigned() {
+			if err := wk.verifyCASignature(); err != nil {
+				logger.Errorf("rejecting windows-ssh-ca-cert entry for %s: %s", wk.UserName, err)
+				continue
+			}
+			if wk.UserName != "" && !wk.expired() && !wk.notYetValid() {
+				*wks = append(*wks, wk)
+			}
+			continue
+		}
+
 		if wk.Exponent != "" && wk.Modulus != "" && wk.UserName != "" && !wk.expired() {
 			*wks = append(*wks, wk)
 		}
@@ -137,29 +434,92 @@ func (wks *windowsKeys) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func updateEtag(resp *http.Response) bool {
-	oldEtag := etag
-	etag = resp.Header.Get("etag")
-	if etag == "" {
-		etag = defaultEtag
+// attemptContext bounds a single WatchMetadata attempt by
+// retryPolicy.PerAttemptTimeout, falling back to a plain cancelable context
+// when no deadline is configured.
+func (c *MetadataClient) attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.retryPolicy.PerAttemptTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	return etag != oldEtag
+	return context.WithTimeout(ctx, c.retryPolicy.PerAttemptTimeout)
 }
 
-func watchMetadata(ctx context.Context) (*metadataJSON, error) {
-	return getMetadata(ctx, true)
+// WatchMetadata blocks on the metadata server's wait_for_change hang until
+// new metadata arrives, the command channel requests an immediate refresh,
+// or an attempt fails with an error the retry policy does not retry. There
+// is no limit on the number of retries. It returns nil, nil once ctx is
+// canceled.
+func (c *MetadataClient) WatchMetadata(ctx context.Context) (*metadataJSON, error) {
+	retryer := c.retryPolicy.newRetryer()
+	for {
+		// Let the command channel cut the hang short: cancel just this
+		// attempt (not the caller's ctx) as soon as a refresh is requested,
+		// then immediately re-fetch without waiting on wait_for_change.
+		// triggered (not hangCtx.Err(), which is also set by both the
+		// per-attempt deadline below and the unconditional cleanup cancel())
+		// is what distinguishes "the command channel asked for a refresh"
+		// from "the hang just completed normally".
+		hangCtx, cancel := c.attemptContext(ctx)
+		triggered := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-metadataTrigger.wait():
+				close(triggered)
+				cancel()
+			case <-done:
+			}
+		}()
+		md, err := c.GetMetadata(hangCtx, true)
+		close(done)
+		attemptExpired := hangCtx.Err() == context.DeadlineExceeded
+		cancel()
+
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		select {
+		case <-triggered:
+			return c.GetMetadata(ctx, false)
+		default:
+		}
+		if err == nil && attemptExpired {
+			err = errPerAttemptTimeout
+		}
+		if err == nil {
+			return md, nil
+		}
+
+		pause, ok := retryer.Retry(err)
+		if !ok {
+			return nil, err
+		}
+		logger.Errorf("metadata request failed, retrying in %s: %v", pause, err)
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-time.After(pause):
+		}
+	}
 }
 
-func getMetadata(ctx context.Context, hang bool) (*metadataJSON, error) {
-	client := &http.Client{
-		Timeout: defaultTimeout,
+// GetMetadata fetches metadata once, over mTLS if a workload certificate is
+// available and falling back to plain HTTP otherwise. When hang is true the
+// request carries wait_for_change/last_etag and may block server-side.
+func (c *MetadataClient) GetMetadata(ctx context.Context, hang bool) (*metadataJSON, error) {
+	if mtls := c.currentMTLSClient(); mtls != nil {
+		md, err := c.getMetadataMTLS(ctx, mtls, hang)
+		if err == nil {
+			return md, nil
+		}
+		logger.Errorf("mTLS metadata request failed, falling back to plain HTTP: %v", err)
 	}
 
-	finalURL := metadataURL + metadataRecursive
+	finalURL := c.baseURL + metadataRecursive
 	if hang {
 		finalURL += metadataHang
 	}
-	finalURL += ("&last_etag=" + etag)
+	finalURL += ("&last_etag=" + c.currentEtag())
 
 	req, err := http.NewRequest("GET", finalURL, nil)
 	if err != nil {
@@ -168,7 +528,7 @@ func getMetadata(ctx context.Context, hang bool) (*metadataJSON, error) {
 	req.Header.Add("Metadata-Flavor", "Google")
 	req = req.WithContext(ctx)
 
-	resp, err := client.Do(req)
+	resp, err := c.httpClient().Do(req)
 	// Don't return error on a canceled context.
 	if err != nil && ctx.Err() != nil {
 		return nil, nil
@@ -176,17 +536,74 @@ func getMetadata(ctx context.Context, hang bool) (*metadataJSON, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &metadataHTTPError{StatusCode: resp.StatusCode}
+	}
 
 	// We return the response even if the etag has not been updated.
 	if hang {
-		updateEtag(resp)
+		c.updateEtag(resp)
 	}
 
 	md, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
 	if err != nil {
 		return nil, err
 	}
 	var metadata metadataJSON
 	return &metadata, json.Unmarshal(md, &metadata)
 }
+
+// getMetadataMTLS fetches metadata over the mTLS-enabled MDS endpoint using
+// client, the http.Client built by refreshMTLSClient from the rotated
+// workload certificate.
+func (c *MetadataClient) getMetadataMTLS(ctx context.Context, client *http.Client, hang bool) (*metadataJSON, error) {
+	finalURL := c.mtlsURL + metadataRecursive
+	if hang {
+		finalURL += metadataHang
+	}
+	finalURL += ("&last_etag=" + c.currentEtag())
+
+	req, err := http.NewRequest("GET", finalURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	req = req.WithContext(ctx)
+
+	resp, err := client.Do(req)
+	if err != nil && ctx.Err() != nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &metadataHTTPError{StatusCode: resp.StatusCode}
+	}
+
+	if hang {
+		c.updateEtag(resp)
+	}
+
+	md, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var metadata metadataJSON
+	return &metadata, json.Unmarshal(md, &metadata)
+}
+
+// defaultMetadataClient is the production client used by the agent's main
+// loop. watchMetadata and getMetadata below are thin wrappers kept for the
+// rest of the package, which still calls them as package-level functions.
+var defaultMetadataClient = NewMetadataClient()
+
+func watchMetadata(ctx context.Context) (*metadataJSON, error) {
+	return defaultMetadataClient.WatchMetadata(ctx)
+}
+
+func getMetadata(ctx context.Context, hang bool) (*metadataJSON, error) {
+	return defaultMetadataClient.GetMetadata(ctx, hang)
+}
@@ -0,0 +1,85 @@
+//  Copyright 2017 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fake is an http.RoundTripper that serves canned recursive metadata JSON
+// and honors the wait_for_change/last_etag semantics of the real GCE
+// metadata server, so the address, account and diagnostics managers can be
+// exercised hermetically via NewMetadataClient(WithTransport(fake)).
+type Fake struct {
+	mu      sync.Mutex
+	body    string
+	etag    string
+	changed chan struct{}
+}
+
+// NewFake returns a Fake serving body with an initial etag of "1".
+func NewFake(body string) *Fake {
+	return &Fake{body: body, etag: "1", changed: make(chan struct{})}
+}
+
+// SetMetadata replaces the body served by subsequent requests, bumps the
+// etag, and unblocks any request currently waiting on wait_for_change.
+func (f *Fake) SetMetadata(body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.body = body
+	if n, err := strconv.Atoi(f.etag); err == nil {
+		f.etag = strconv.Itoa(n + 1)
+	} else {
+		f.etag = "1"
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// RoundTrip implements http.RoundTripper.
+func (f *Fake) RoundTrip(req *http.Request) (*http.Response, error) {
+	q := req.URL.Query()
+	for {
+		f.mu.Lock()
+		etag, body, changed := f.etag, f.body, f.changed
+		f.mu.Unlock()
+
+		if q.Get("wait_for_change") != "true" || q.Get("last_etag") != etag {
+			return f.response(req, etag, body), nil
+		}
+
+		select {
+		case <-changed:
+			continue
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func (f *Fake) response(req *http.Request, etag, body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Header:     http.Header{"Etag": []string{etag}},
+		Request:    req,
+	}
+}
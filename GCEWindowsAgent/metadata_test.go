@@ -0,0 +1,449 @@
+//  Copyright 2017 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func fakeClient(fake *Fake) *MetadataClient {
+	return NewMetadataClient(WithTransport(fake), WithBaseURL("http://metadata.fake/computeMetadata/v1/"))
+}
+
+func TestGetMetadataFake(t *testing.T) {
+	client := fakeClient(NewFake(`{"Project":{"ProjectID":"fake-project"}}`))
+
+	md, err := client.GetMetadata(context.Background(), false)
+	if err != nil {
+		t.Fatalf("GetMetadata: %v", err)
+	}
+	if md.Project.ProjectID != "fake-project" {
+		t.Errorf("ProjectID = %q, want fake-project", md.Project.ProjectID)
+	}
+}
+
+func TestWatchMetadataWaitsForEtagChange(t *testing.T) {
+	fake := NewFake(`{"Project":{"ProjectID":"v1"}}`)
+	client := fakeClient(fake)
+
+	// Seed the client's etag so the next WatchMetadata call actually hangs
+	// on wait_for_change instead of returning immediately.
+	if _, err := client.GetMetadata(context.Background(), true); err != nil {
+		t.Fatalf("seed GetMetadata: %v", err)
+	}
+
+	done := make(chan *metadataJSON, 1)
+	errs := make(chan error, 1)
+	go func() {
+		md, err := client.WatchMetadata(context.Background())
+		if err != nil {
+			errs <- err
+			return
+		}
+		done <- md
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("WatchMetadata returned before the fake's metadata changed")
+	case err := <-errs:
+		t.Fatalf("WatchMetadata: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fake.SetMetadata(`{"Project":{"ProjectID":"v2"}}`)
+
+	select {
+	case md := <-done:
+		if md.Project.ProjectID != "v2" {
+			t.Errorf("ProjectID = %q, want v2", md.Project.ProjectID)
+		}
+	case err := <-errs:
+		t.Fatalf("WatchMetadata: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("WatchMetadata did not return after SetMetadata")
+	}
+}
+
+func TestWatchMetadataTriggerShortCircuitsTheHang(t *testing.T) {
+	fake := NewFake(`{"Project":{"ProjectID":"v1"}}`)
+	client := fakeClient(fake)
+
+	if _, err := client.GetMetadata(context.Background(), true); err != nil {
+		t.Fatalf("seed GetMetadata: %v", err)
+	}
+
+	done := make(chan *metadataJSON, 1)
+	errs := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		md, err := client.WatchMetadata(context.Background())
+		if err != nil {
+			errs <- err
+			return
+		}
+		done <- md
+	}()
+
+	// Give WatchMetadata time to start hanging before triggering a refresh.
+	// This is the same command-channel trigger wired up in command.go.
+	time.Sleep(20 * time.Millisecond)
+	metadataTrigger.trigger()
+
+	select {
+	case md := <-done:
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("WatchMetadata took %s to return after the trigger fired, want well under 1s", elapsed)
+		}
+		if md.Project.ProjectID != "v1" {
+			t.Errorf("ProjectID = %q, want v1", md.Project.ProjectID)
+		}
+	case err := <-errs:
+		t.Fatalf("WatchMetadata: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("WatchMetadata did not return after the trigger fired")
+	}
+}
+
+func TestWatchMetadataNoTriggerFetchesOnce(t *testing.T) {
+	var requests int
+	countingFake := &countingRoundTripper{Fake: NewFake(`{"Project":{"ProjectID":"v1"}}`), count: &requests}
+	client := NewMetadataClient(WithTransport(countingFake), WithBaseURL("http://metadata.fake/computeMetadata/v1/"))
+
+	if _, err := client.GetMetadata(context.Background(), true); err != nil {
+		t.Fatalf("seed GetMetadata: %v", err)
+	}
+	requests = 0
+
+	countingFake.Fake.SetMetadata(`{"Project":{"ProjectID":"v2"}}`)
+
+	md, err := client.WatchMetadata(context.Background())
+	if err != nil {
+		t.Fatalf("WatchMetadata: %v", err)
+	}
+	if md.Project.ProjectID != "v2" {
+		t.Errorf("ProjectID = %q, want v2", md.Project.ProjectID)
+	}
+	if requests != 1 {
+		t.Errorf("WatchMetadata made %d requests with no trigger fired, want 1", requests)
+	}
+}
+
+type countingRoundTripper struct {
+	*Fake
+	count *int
+}
+
+func (c *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	*c.count++
+	return c.Fake.RoundTrip(req)
+}
+
+type alwaysErrTransport struct{}
+
+func (alwaysErrTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("mtls endpoint unreachable")
+}
+
+// TestWatchMetadataRetriesAfterPerAttemptTimeout checks that a hang which
+// outlives backoffPolicy.PerAttemptTimeout is treated as a retryable
+// failure rather than a silent, premature return.
+func TestWatchMetadataRetriesAfterPerAttemptTimeout(t *testing.T) {
+	var requests int
+	fake := &countingRoundTripper{Fake: NewFake(`{"Project":{"ProjectID":"v1"}}`), count: &requests}
+	client := NewMetadataClient(WithTransport(fake), WithBaseURL("http://metadata.fake/computeMetadata/v1/"))
+	client.retryPolicy = backoffPolicy{Initial: time.Millisecond, Max: 5 * time.Millisecond, Multiplier: 2, PerAttemptTimeout: 15 * time.Millisecond}
+
+	if _, err := client.GetMetadata(context.Background(), true); err != nil {
+		t.Fatalf("seed GetMetadata: %v", err)
+	}
+	requests = 0
+
+	done := make(chan *metadataJSON, 1)
+	errs := make(chan error, 1)
+	go func() {
+		md, err := client.WatchMetadata(context.Background())
+		if err != nil {
+			errs <- err
+			return
+		}
+		done <- md
+	}()
+
+	// Give a few per-attempt timeouts a chance to fire before the fake ever
+	// changes, so the hang can only have returned via retry, not a real
+	// wait_for_change wakeup.
+	time.Sleep(80 * time.Millisecond)
+	fake.Fake.SetMetadata(`{"Project":{"ProjectID":"v2"}}`)
+
+	select {
+	case md := <-done:
+		if md.Project.ProjectID != "v2" {
+			t.Errorf("ProjectID = %q, want v2", md.Project.ProjectID)
+		}
+	case err := <-errs:
+		t.Fatalf("WatchMetadata: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("WatchMetadata did not return after SetMetadata")
+	}
+
+	if requests < 2 {
+		t.Errorf("requests = %d, want at least 2 (the per-attempt timeout should have forced a retry before SetMetadata)", requests)
+	}
+}
+
+// TestWindowsSSHCACertValidatesAgainstSameProjectPayload reproduces the real
+// MDS response shape, where "instance" sorts before "project" in the JSON
+// text, and checks that a windows-ssh-ca-cert entry is validated against the
+// ssh-ca-public-key introduced in that same payload rather than a stale or
+// empty value left over from a previous poll.
+func TestWindowsSSHCACertValidatesAgainstSameProjectPayload(t *testing.T) {
+	sshCAPublicKey = ""
+	defer func() { sshCAPublicKey = "" }()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	wk := windowsKey{
+		UserName:   "bob",
+		Principals: []string{"bob"},
+		ValidAfter: "2000-01-01T00:00:00Z",
+		ExpireOn:   "2999-01-01T00:00:00Z",
+	}
+	wk.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, wk.signedPayload()))
+
+	line, err := json.Marshal(wk)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"Instance": map[string]interface{}{
+			"Attributes": map[string]interface{}{
+				"windows-ssh-ca-cert": string(line),
+			},
+		},
+		"Project": map[string]interface{}{
+			"Attributes": map[string]interface{}{
+				"ssh-ca-public-key": base64.StdEncoding.EncodeToString(pub),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Marshal payload: %v", err)
+	}
+
+	var md metadataJSON
+	if err := json.Unmarshal(payload, &md); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	if got := len(md.Instance.Attributes.WindowsSSHCACert); got != 1 {
+		t.Fatalf("WindowsSSHCACert = %d entries, want 1 (entry should validate against the ssh-ca-public-key in this same payload)", got)
+	}
+	if got := md.Instance.Attributes.WindowsSSHCACert[0].UserName; got != "bob" {
+		t.Errorf("UserName = %q, want bob", got)
+	}
+}
+
+func TestVerifyCASignature(t *testing.T) {
+	sshCAPublicKey = ""
+	defer func() { sshCAPublicKey = "" }()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	wk := windowsKey{UserName: "bob", Principals: []string{"bob"}, ValidAfter: "2000-01-01T00:00:00Z", ExpireOn: "2999-01-01T00:00:00Z"}
+	sig := ed25519.Sign(priv, wk.signedPayload())
+
+	t.Run("valid signature", func(t *testing.T) {
+		sshCAPublicKey = base64.StdEncoding.EncodeToString(pub)
+		wk.Signature = base64.StdEncoding.EncodeToString(sig)
+		if err := wk.verifyCASignature(); err != nil {
+			t.Errorf("verifyCASignature: %v, want nil", err)
+		}
+	})
+
+	t.Run("no CA key configured", func(t *testing.T) {
+		sshCAPublicKey = ""
+		wk.Signature = base64.StdEncoding.EncodeToString(sig)
+		if err := wk.verifyCASignature(); err == nil {
+			t.Error("verifyCASignature = nil, want error")
+		}
+	})
+
+	t.Run("signature from the wrong key", func(t *testing.T) {
+		sshCAPublicKey = base64.StdEncoding.EncodeToString(otherPub)
+		wk.Signature = base64.StdEncoding.EncodeToString(sig)
+		if err := wk.verifyCASignature(); err == nil {
+			t.Error("verifyCASignature = nil, want error for a signature from a different CA key")
+		}
+	})
+
+	t.Run("tampered payload", func(t *testing.T) {
+		sshCAPublicKey = base64.StdEncoding.EncodeToString(pub)
+		tampered := wk
+		tampered.UserName = "eve"
+		tampered.Signature = base64.StdEncoding.EncodeToString(sig)
+		if err := tampered.verifyCASignature(); err == nil {
+			t.Error("verifyCASignature = nil, want error when the signed fields have changed")
+		}
+	})
+
+	t.Run("malformed signature encoding", func(t *testing.T) {
+		sshCAPublicKey = base64.StdEncoding.EncodeToString(pub)
+		wk.Signature = "not-base64!!"
+		if err := wk.verifyCASignature(); err == nil {
+			t.Error("verifyCASignature = nil, want error for malformed base64")
+		}
+	})
+}
+
+func TestCASigned(t *testing.T) {
+	if (&windowsKey{}).caSigned() {
+		t.Error("caSigned = true for a key with no Signature, want false")
+	}
+	if !(&windowsKey{Signature: "sig"}).caSigned() {
+		t.Error("caSigned = false for a key with a Signature, want true")
+	}
+}
+
+func TestNotYetValid(t *testing.T) {
+	cases := []struct {
+		name       string
+		validAfter string
+		want       bool
+	}{
+		{"no ValidAfter set", "", false},
+		{"ValidAfter in the past", time.Now().Add(-time.Hour).Format(time.RFC3339), false},
+		{"ValidAfter in the future", time.Now().Add(time.Hour).Format(time.RFC3339), true},
+		{"unparseable ValidAfter", "not-a-timestamp", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			wk := windowsKey{ValidAfter: tc.validAfter}
+			if got := wk.notYetValid(); got != tc.want {
+				t.Errorf("notYetValid() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// generateSelfSignedCertPEM returns a throwaway self-signed cert/key pair
+// for exercising refreshMTLSClient's disk-reading path without real MDS
+// credentials.
+func generateSelfSignedCertPEM(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mds-mtls-client-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// TestMTLSRefresherStartsAtConstruction covers both the NewMetadataClient
+// startup fix (the refresher must not depend on which method is called
+// first) and refreshMTLSClient's disk-reading path, which previously had no
+// coverage at all - only the already-built-client-fails fallback was
+// tested.
+func TestMTLSRefresherStartsAtConstruction(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM := generateSelfSignedCertPEM(t)
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	rootPath := filepath.Join(dir, "root.pem")
+	if err := os.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	if err := os.WriteFile(rootPath, certPEM, 0600); err != nil {
+		t.Fatalf("write root: %v", err)
+	}
+
+	origCert, origKey, origRoot := workloadCertPath, workloadKeyPath, mdsRootCACert
+	workloadCertPath, workloadKeyPath, mdsRootCACert = certPath, keyPath, rootPath
+	defer func() { workloadCertPath, workloadKeyPath, mdsRootCACert = origCert, origKey, origRoot }()
+
+	client := NewMetadataClient(WithTransport(NewFake(`{}`)))
+	if client.currentMTLSClient() == nil {
+		t.Fatal("expected NewMetadataClient to load the mTLS client from disk at construction, not lazily on first WatchMetadata call")
+	}
+
+	if err := os.Remove(certPath); err != nil {
+		t.Fatalf("remove cert: %v", err)
+	}
+	client.refreshMTLSClient()
+	if client.currentMTLSClient() != nil {
+		t.Error("expected the mTLS client to clear once the cert file disappears")
+	}
+}
+
+func TestGetMetadataFallsBackWhenMTLSFails(t *testing.T) {
+	fake := NewFake(`{"Project":{"ProjectID":"plain-http-fallback"}}`)
+	client := fakeClient(fake)
+	client.setMTLSClient(&http.Client{Transport: alwaysErrTransport{}})
+
+	md, err := client.GetMetadata(context.Background(), false)
+	if err != nil {
+		t.Fatalf("GetMetadata: %v", err)
+	}
+	if md.Project.ProjectID != "plain-http-fallback" {
+		t.Errorf("ProjectID = %q, want plain-http-fallback", md.Project.ProjectID)
+	}
+}
@@ -0,0 +1,118 @@
+//  Copyright 2017 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// retryer decides whether a failed attempt should be retried and, if so,
+// how long to pause first. Modeled on the gax.Retryer used by
+// cloud.google.com/go/internal.
+type retryer interface {
+	Retry(err error) (pause time.Duration, ok bool)
+}
+
+// backoffPolicy is the configuration for an exponential backoff with
+// jitter. metadataRetryPolicy is the package-level default; NewMetadataClient
+// copies it into each client's retryPolicy, so a change to it applies only to
+// clients built afterwards, not to defaultMetadataClient, which is built at
+// package initialization. newRetryer seeds a fresh, stateful retryer from a
+// client's policy for each WatchMetadata retry loop. PerAttemptTimeout bounds each
+// individual attempt's context, independent of backoff between attempts, so
+// a single hung request can't stall watchMetadata indefinitely regardless
+// of the http.Client's own timeout.
+type backoffPolicy struct {
+	Initial           time.Duration
+	Max               time.Duration
+	Multiplier        float64
+	PerAttemptTimeout time.Duration
+}
+
+// metadataRetryPolicy controls how watchMetadata retries transient failures
+// (network errors, 5xx, 429) from the metadata server. PerAttemptTimeout is
+// set above the metadataHang wait_for_change window plus margin for the
+// round trip itself.
+var metadataRetryPolicy = backoffPolicy{
+	Initial:           200 * time.Millisecond,
+	Max:               10 * time.Second,
+	Multiplier:        2,
+	PerAttemptTimeout: 90 * time.Second,
+}
+
+func (p backoffPolicy) newRetryer() retryer {
+	return &backoff{policy: p, cur: p.Initial}
+}
+
+type backoff struct {
+	policy backoffPolicy
+	cur    time.Duration
+}
+
+// Retry reports whether err is transient and, if so, returns the jittered
+// pause before the next attempt. ok is false for non-retryable errors.
+func (b *backoff) Retry(err error) (time.Duration, bool) {
+	if !isRetryableMetadataError(err) {
+		return 0, false
+	}
+
+	pause := jitter(b.cur)
+	b.cur = time.Duration(float64(b.cur) * b.policy.Multiplier)
+	if b.cur > b.policy.Max {
+		b.cur = b.policy.Max
+	}
+	return pause, true
+}
+
+// jitter randomizes d by up to +/-20% so that concurrently retrying agents
+// don't all hammer the metadata server in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d - d/5 + time.Duration(rand.Int63n(int64(d*2/5+1)))
+}
+
+// errPerAttemptTimeout is the error watchMetadata retries on when an
+// attempt's context hits backoffPolicy.PerAttemptTimeout without either a
+// response or a command-channel trigger.
+var errPerAttemptTimeout = errors.New("metadata request exceeded its per-attempt deadline")
+
+// metadataHTTPError wraps a non-2xx response from the metadata server so
+// isRetryableMetadataError can classify it without re-parsing the response.
+type metadataHTTPError struct {
+	StatusCode int
+}
+
+func (e *metadataHTTPError) Error() string {
+	return fmt.Sprintf("metadata server returned status %d", e.StatusCode)
+}
+
+// isRetryableMetadataError reports whether err should be retried: a 5xx/429
+// response from the metadata server, or any error that is not a
+// metadataHTTPError.
+func isRetryableMetadataError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if httpErr, ok := err.(*metadataHTTPError); ok {
+		return httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode >= 500
+	}
+	// Anything else reaching here is retryable: network errors (connection
+	// refused, timeout, DNS failure, etc.), errPerAttemptTimeout, and also
+	// errors reading or decoding the response body.
+	return true
+}
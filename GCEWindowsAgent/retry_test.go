@@ -0,0 +1,85 @@
+//  Copyright 2017 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackoffRetryProgression(t *testing.T) {
+	policy := backoffPolicy{Initial: 10 * time.Millisecond, Max: 40 * time.Millisecond, Multiplier: 2}
+	r := policy.newRetryer()
+
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond}
+	for i, w := range want {
+		pause, ok := r.Retry(errors.New("boom"))
+		if !ok {
+			t.Fatalf("attempt %d: Retry ok = false, want true for a retryable error", i)
+		}
+		lo, hi := w-w/5, w+w/5
+		if pause < lo || pause > hi {
+			t.Errorf("attempt %d: pause = %s, want in [%s, %s]", i, pause, lo, hi)
+		}
+	}
+}
+
+func TestBackoffRetryRejectsNonRetryableErrors(t *testing.T) {
+	policy := backoffPolicy{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1}
+	r := policy.newRetryer()
+
+	if _, ok := r.Retry(nil); ok {
+		t.Error("Retry(nil) ok = true, want false")
+	}
+	if _, ok := r.Retry(&metadataHTTPError{StatusCode: http.StatusNotFound}); ok {
+		t.Error("Retry(404) ok = true, want false")
+	}
+}
+
+func TestIsRetryableMetadataError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"network error", errors.New("connection refused"), true},
+		{"per-attempt timeout", errPerAttemptTimeout, true},
+		{"429", &metadataHTTPError{StatusCode: http.StatusTooManyRequests}, true},
+		{"500", &metadataHTTPError{StatusCode: http.StatusInternalServerError}, true},
+		{"503", &metadataHTTPError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"404", &metadataHTTPError{StatusCode: http.StatusNotFound}, false},
+		{"400", &metadataHTTPError{StatusCode: http.StatusBadRequest}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isRetryableMetadataError(tc.err); got != tc.want {
+				t.Errorf("isRetryableMetadataError(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestJitterStaysWithinBounds(t *testing.T) {
+	d := 100 * time.Millisecond
+	lo, hi := d-d/5, d+d/5
+	for i := 0; i < 100; i++ {
+		if got := jitter(d); got < lo || got > hi {
+			t.Fatalf("jitter(%s) = %s, want in [%s, %s]", d, got, lo, hi)
+		}
+	}
+}